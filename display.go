@@ -0,0 +1,178 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"time"
+)
+
+// certWithName pairs a parsed certificate with whatever name/error info is
+// known about where it came from (e.g. a key store alias), so the simple*
+// constructors below have somewhere to hang that context.
+type certWithName struct {
+	cert *x509.Certificate
+	name string
+	err  error
+}
+
+// simpleCertificate is the JSON/human-readable projection of an x509
+// certificate that certigo prints out of dump/connect/verify.
+type simpleCertificate struct {
+	Subject            pkixName  `json:"subject"`
+	Issuer             pkixName  `json:"issuer"`
+	SerialNumber       string    `json:"serial"`
+	NotBefore          time.Time `json:"not_before"`
+	NotAfter           time.Time `json:"not_after"`
+	DNSNames           []string  `json:"dns_names,omitempty"`
+	SignatureAlgorithm string    `json:"signature_algorithm"`
+
+	SHA1Fingerprint   string `json:"sha1_fingerprint"`
+	SHA256Fingerprint string `json:"sha256_fingerprint"`
+	SPKIPin           string `json:"spki_sha256_pin"`
+
+	PublicKeyAlgorithm string `json:"public_key_algorithm"`
+
+	KeyUsage    []string `json:"key_usage,omitempty"`
+	ExtKeyUsage []string `json:"ext_key_usage,omitempty"`
+
+	IsCA    bool `json:"is_ca"`
+	PathLen *int `json:"path_len,omitempty"`
+
+	SubjectKeyID   string `json:"subject_key_id,omitempty"`
+	AuthorityKeyID string `json:"authority_key_id,omitempty"`
+
+	SelfSigned bool `json:"self_signed"`
+}
+
+// pkixName is a trimmed-down, JSON-friendly view of pkix.Name.
+type pkixName struct {
+	CommonName   string   `json:"common_name,omitempty"`
+	Organization []string `json:"organization,omitempty"`
+}
+
+// simpleResult is the top-level JSON object emitted by dump/connect (verify
+// emits a bare VerifyResult).
+type simpleResult struct {
+	Certificates []simpleCertificate `json:"certificates"`
+	VerifyResult *VerifyResult       `json:"verify_result,omitempty"`
+	Handshake    *handshakeInfo      `json:"handshake,omitempty"`
+}
+
+// createSimpleCertificate builds a simpleCertificate from an already-parsed
+// certificate (as returned by a live TLS connection or PKCS7 bundle).
+func createSimpleCertificate(c certWithName) simpleCertificate {
+	cert := c.cert
+
+	var pathLen *int
+	if cert.IsCA && (cert.MaxPathLen > 0 || cert.MaxPathLenZero) {
+		pathLen = &cert.MaxPathLen
+	}
+
+	return simpleCertificate{
+		Subject:            simplePkixName(cert.Subject),
+		Issuer:             simplePkixName(cert.Issuer),
+		SerialNumber:       cert.SerialNumber.String(),
+		NotBefore:          cert.NotBefore,
+		NotAfter:           cert.NotAfter,
+		DNSNames:           cert.DNSNames,
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+
+		SHA1Fingerprint:   sha1Fingerprint(cert),
+		SHA256Fingerprint: sha256Fingerprint(cert),
+		SPKIPin:           spkiPin(cert),
+
+		PublicKeyAlgorithm: describePublicKey(cert),
+
+		KeyUsage:    decodeKeyUsage(cert.KeyUsage),
+		ExtKeyUsage: decodeExtKeyUsage(cert.ExtKeyUsage),
+
+		IsCA:    cert.IsCA,
+		PathLen: pathLen,
+
+		SubjectKeyID:   hexOrEmpty(cert.SubjectKeyId),
+		AuthorityKeyID: hexOrEmpty(cert.AuthorityKeyId),
+
+		SelfSigned: isSelfSigned(cert),
+	}
+}
+
+// createSimpleCertificateFromX509 parses a raw CERTIFICATE pem.Block and
+// hands it off to createSimpleCertificate.
+func createSimpleCertificateFromX509(block *pem.Block) simpleCertificate {
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return simpleCertificate{}
+	}
+	return createSimpleCertificate(certWithName{cert: cert})
+}
+
+func hexOrEmpty(id []byte) string {
+	if len(id) == 0 {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+func simplePkixName(name pkix.Name) pkixName {
+	return pkixName{
+		CommonName:   name.CommonName,
+		Organization: name.Organization,
+	}
+}
+
+// displayCert prints a simpleCertificate in the human-readable format used
+// by dump/connect when --json isn't given.
+func displayCert(cert simpleCertificate) {
+	fmt.Printf("Serial Number: %s\n", cert.SerialNumber)
+	fmt.Printf("Subject: CN=%s\n", cert.Subject.CommonName)
+	fmt.Printf("Issuer: CN=%s\n", cert.Issuer.CommonName)
+	fmt.Printf("Not Before: %s\n", cert.NotBefore)
+	fmt.Printf("Not After: %s\n", cert.NotAfter)
+	if len(cert.DNSNames) > 0 {
+		fmt.Printf("DNS Names: %v\n", cert.DNSNames)
+	}
+	fmt.Printf("Signature Algorithm: %s\n", cert.SignatureAlgorithm)
+	fmt.Printf("Public Key Algorithm: %s\n", cert.PublicKeyAlgorithm)
+	fmt.Printf("SHA-1 Fingerprint: %s\n", cert.SHA1Fingerprint)
+	fmt.Printf("SHA-256 Fingerprint: %s\n", cert.SHA256Fingerprint)
+	fmt.Printf("SPKI SHA-256 Pin: %s\n", cert.SPKIPin)
+	if len(cert.KeyUsage) > 0 {
+		fmt.Printf("Key Usage: %v\n", cert.KeyUsage)
+	}
+	if len(cert.ExtKeyUsage) > 0 {
+		fmt.Printf("Extended Key Usage: %v\n", cert.ExtKeyUsage)
+	}
+	if cert.IsCA {
+		if cert.PathLen != nil {
+			fmt.Printf("CA: true (path len %d)\n", *cert.PathLen)
+		} else {
+			fmt.Printf("CA: true\n")
+		}
+	}
+	if cert.SubjectKeyID != "" {
+		fmt.Printf("Subject Key ID: %s\n", cert.SubjectKeyID)
+	}
+	if cert.AuthorityKeyID != "" {
+		fmt.Printf("Authority Key ID: %s\n", cert.AuthorityKeyID)
+	}
+	fmt.Printf("Self-Signed: %v\n", cert.SelfSigned)
+}
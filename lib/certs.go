@@ -0,0 +1,107 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package lib contains the shared plumbing certigo's subcommands use to turn
+// whatever an operator hands us -- a PEM file, a raw DER blob, or a PKCS#11
+// token -- into a stream of pem.Block values.
+package lib
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// PasswordReader is called (lazily, at most once per store) to obtain a
+// password for an encrypted key store. The alias identifies which entry the
+// password is for, if the store format exposes that.
+type PasswordReader func(alias string) string
+
+// BlockHandler is invoked once per certificate found in the input.
+type BlockHandler func(block *pem.Block)
+
+// ReadCerts reads certificates out of the given files and invokes handler once
+// per PEM block it decodes (PKCS#11 tokens are read by ReadPKCS11 instead).
+// format may be "PEM", "DER", or empty to have the format guessed from the
+// content of each file; any other format, including JCEKS and PKCS12, is
+// rejected with an unsupported-format error. passReader is not called.
+func ReadCerts(files []*os.File, format string, passReader PasswordReader, handler BlockHandler) error {
+	for _, file := range files {
+		raw, err := ioutil.ReadAll(file)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %s", file.Name(), err)
+		}
+
+		guessed := format
+		if guessed == "" {
+			guessed = guessFormat(raw)
+		}
+
+		switch strings.ToUpper(guessed) {
+		case "DER":
+			block := &pem.Block{Type: "CERTIFICATE", Bytes: raw}
+			if _, err := x509.ParseCertificate(raw); err != nil {
+				// Not a single certificate -- try to read it as a
+				// concatenation of DER certs (e.g. pkcs7 degenerate case).
+				certs, err := x509.ParseCertificates(raw)
+				if err != nil {
+					return fmt.Errorf("unable to parse DER in %s: %s", file.Name(), err)
+				}
+				for _, cert := range certs {
+					handler(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+				}
+				continue
+			}
+			handler(block)
+		case "PEM", "":
+			rest := raw
+			for {
+				var block *pem.Block
+				block, rest = pem.Decode(rest)
+				if block == nil {
+					break
+				}
+				handler(block)
+			}
+		default:
+			return fmt.Errorf("unsupported format %q for %s", guessed, file.Name())
+		}
+	}
+	return nil
+}
+
+// guessFormat does a cheap heuristic check for a PEM armor header; anything
+// else is assumed to be raw DER.
+func guessFormat(raw []byte) string {
+	if bytes.Contains(raw, []byte("-----BEGIN")) {
+		return "PEM"
+	}
+	return "DER"
+}
+
+// CertToPem renders an x509 certificate as a PEM block, optionally carrying
+// the given headers (e.g. a friendly name extracted from a key store).
+func CertToPem(cert *x509.Certificate, headers map[string]string) *pem.Block {
+	return &pem.Block{
+		Type:    "CERTIFICATE",
+		Headers: headers,
+		Bytes:   cert.Raw,
+	}
+}
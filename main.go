@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"net"
 	"os"
 	"strings"
 
@@ -35,26 +36,49 @@ import (
 var (
 	app = kingpin.New("certigo", "A command line certificate examination utility.")
 
-	dump         = app.Command("dump", "Display information about a certificate from a file/stdin.")
-	dumpFiles    = dump.Arg("file", "Certificate file to dump (or stdin if not specified).").ExistingFiles()
-	dumpType     = dump.Flag("format", "Format of given input (PEM, DER, JCEKS, PKCS12; heuristic if missing).").String()
-	dumpPem      = dump.Flag("pem", "Write output as PEM blocks instead of human-readable format.").Bool()
-	dumpPassword = dump.Flag("password", "Password for PKCS12/JCEKS key stores (if required).").String()
-	dumpJSON     = dump.Flag("json", "Write output as machine-readable JSON format.").Bool()
-
-	connect       = app.Command("connect", "Connect to a server and print its certificate(s).")
-	connectTo     = connect.Arg("server:port", "Hostname or IP to connect to.").String()
-	connectName   = connect.Flag("name", "Override the server name used for Server Name Indication (SNI).").String()
-	connectCaPath = connect.Flag("ca", "Path to CA bundle (system default if unspecified).").ExistingFile()
-	connectPem    = connect.Flag("pem", "Write output as PEM blocks instead of human-readable format.").Bool()
-	connectJSON   = connect.Flag("json", "Write output as machine-readable JSON format.").Bool()
-
-	verify       = app.Command("verify", "Verify a certificate chain from file/stdin against a name.")
-	verifyFile   = verify.Arg("file", "Certificate file to dump (or stdin if not specified).").ExistingFile()
-	verifyName   = verify.Flag("name", "Server name to verify certificate against.").Required().String()
-	verifyCaPath = verify.Flag("ca", "Path to CA bundle (system default if unspecified).").ExistingFile()
-	verifyType   = dump.Flag("format", "Format of given input (PEM, DER, JCEKS, PKCS12; heuristic if missing).").String()
-	verifyJSON   = verify.Flag("json", "Write output as machine-readable JSON format.").Bool()
+	dump          = app.Command("dump", "Display information about a certificate from a file/stdin.")
+	dumpFiles     = dump.Arg("file", "Certificate file to dump, a pkcs11: token URI, or stdin if not specified.").Strings()
+	dumpType      = dump.Flag("format", "Format of given input (PEM, DER, PKCS11; heuristic if missing).").String()
+	dumpPem       = dump.Flag("pem", "Write output as PEM blocks instead of human-readable format.").Bool()
+	dumpPassword  = dump.Flag("password", "PIN for a PKCS#11 token (prompted for if not given).").String()
+	dumpJSON      = dump.Flag("json", "Write output as machine-readable JSON format.").Bool()
+	dumpPKCS11Mod = dump.Flag("pkcs11-module", "Path to PKCS#11 module (default varies by platform; overrides pkcs11: URI and $CERTIGO_PKCS11_MODULE).").String()
+
+	connect            = app.Command("connect", "Connect to a server and print its certificate(s).")
+	connectTo          = connect.Arg("server:port", "Hostname or IP to connect to.").String()
+	connectName        = connect.Flag("name", "Override the server name used for Server Name Indication (SNI).").String()
+	connectCaPath      = connect.Flag("ca", "Path to CA bundle (system default if unspecified).").ExistingFile()
+	connectPem         = connect.Flag("pem", "Write output as PEM blocks instead of human-readable format.").Bool()
+	connectJSON        = connect.Flag("json", "Write output as machine-readable JSON format.").Bool()
+	connectRevocation  = connect.Flag("check-revocation", "How to check revocation status: none, ocsp, crl, or both.").Default(string(revocationBoth)).Enum("none", "ocsp", "crl", "both")
+	connectOCSPTimeout = connect.Flag("ocsp-timeout", "Timeout for OCSP requests.").Default("5s").Duration()
+	connectStartTLS    = connect.Flag("start-tls", "Negotiate a TLS session over a plaintext protocol: smtp, imap, pop3, ftp, xmpp, postgres, mysql, or ldap.").Enum("", "smtp", "imap", "pop3", "ftp", "xmpp", "postgres", "mysql", "ldap")
+	connectCert        = connect.Flag("cert", "Client certificate to present (PEM, or PKCS12 with --cert-password).").ExistingFile()
+	connectKey         = connect.Flag("key", "Client private key to present, if --cert is a PEM file.").ExistingFile()
+	connectCertPass    = connect.Flag("cert-password", "Password for a PKCS12 --cert.").String()
+	connectMinVersion  = connect.Flag("min-version", "Minimum TLS version to offer: 1.0, 1.1, 1.2, or 1.3.").String()
+	connectMaxVersion  = connect.Flag("max-version", "Maximum TLS version to offer: 1.0, 1.1, 1.2, or 1.3.").String()
+	connectCiphers     = connect.Flag("cipher", "Cipher suite to offer (may be repeated); defaults to Go's own preference order.").Strings()
+	connectCurves      = connect.Flag("curve", "Elliptic curve to offer (may be repeated): p256, p384, p521, or x25519.").Strings()
+	connectALPN        = connect.Flag("alpn", "ALPN protocol to negotiate (may be repeated).").Strings()
+
+	verify            = app.Command("verify", "Verify a certificate chain from file/stdin against a name.")
+	verifyFile        = verify.Arg("file", "Certificate file to dump, a pkcs11: token URI, or stdin if not specified.").String()
+	verifyName        = verify.Flag("name", "Server name to verify certificate against.").Required().String()
+	verifyCaPath      = verify.Flag("ca", "Path to CA bundle (system default if unspecified).").ExistingFile()
+	verifyType        = verify.Flag("format", "Format of given input (PEM, DER, PKCS11; heuristic if missing).").String()
+	verifyJSON        = verify.Flag("json", "Write output as machine-readable JSON format.").Bool()
+	verifyRevocation  = verify.Flag("check-revocation", "How to check revocation status: none, ocsp, crl, or both.").Default(string(revocationBoth)).Enum("none", "ocsp", "crl", "both")
+	verifyOCSPTimeout = verify.Flag("ocsp-timeout", "Timeout for OCSP requests.").Default("5s").Duration()
+	verifyPKCS11Mod   = verify.Flag("pkcs11-module", "Path to PKCS#11 module (default varies by platform; overrides pkcs11: URI and $CERTIGO_PKCS11_MODULE).").String()
+
+	scan                = app.Command("scan", "Scan a list of host:port targets and report certificate/expiry info.")
+	scanTargetsFile     = scan.Arg("targets", "File with one 'host:port [sni=...] [starttls=...] [name=...]' target per line.").Required().ExistingFile()
+	scanConcurrency     = scan.Flag("concurrency", "Number of concurrent handshakes.").Default("10").Int()
+	scanTimeout         = scan.Flag("timeout", "Per-target dial+handshake timeout.").Default("10s").Duration()
+	scanCaPath          = scan.Flag("ca", "Path to CA bundle (system default if unspecified).").ExistingFile()
+	scanExpiryThreshold = scan.Flag("expiry-threshold", "Exit non-zero if any leaf expires sooner than this.").Default("720h").Duration()
+	scanDiffAgainst     = scan.Flag("diff-against", "Previous scan JSONL snapshot to diff fingerprints against.").ExistingFile()
 )
 
 func main() {
@@ -63,14 +87,7 @@ func main() {
 	result := simpleResult{}
 	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
 	case dump.FullCommand(): // Dump certificate
-		files := inputFiles(*dumpFiles)
-		defer func() {
-			for _, file := range files {
-				file.Close()
-			}
-		}()
-
-		lib.ReadCerts(files, *dumpType, readPassword, func(block *pem.Block) {
+		onBlock := func(block *pem.Block) {
 			if *dumpPem {
 				block.Headers = nil
 				pem.Encode(os.Stdout, block)
@@ -90,7 +107,23 @@ func main() {
 					result.Certificates = append(result.Certificates, createSimpleCertificate(certWithName{cert: cert}))
 				}
 			}
-		})
+		}
+
+		if uri, ok := pkcs11Arg(*dumpType, *dumpFiles); ok {
+			uri.Module = firstNonEmpty(*dumpPKCS11Mod, uri.Module)
+			if err := lib.ReadPKCS11(uri, readPassword, onBlock); err != nil {
+				fmt.Fprintf(os.Stderr, "error reading PKCS#11 token: %s\n", err)
+				os.Exit(1)
+			}
+		} else {
+			files := inputFiles(*dumpFiles)
+			defer func() {
+				for _, file := range files {
+					file.Close()
+				}
+			}()
+			lib.ReadCerts(files, *dumpType, readPassword, onBlock)
+		}
 
 		if *dumpJSON {
 			blob, _ := json.Marshal(result)
@@ -104,16 +137,46 @@ func main() {
 		}
 
 	case connect.FullCommand(): // Get certs by connecting to a server
-		conn, err := tls.Dial("tcp", *connectTo, &tls.Config{
-			// We verify later manually so we can print results
-			InsecureSkipVerify: true,
-			ServerName:         *connectName,
-		})
+		hostname := *connectName
+		if hostname == "" {
+			hostname = strings.Split(*connectTo, ":")[0]
+		}
+
+		raw, err := net.Dial("tcp", *connectTo)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error connecting: %v\n", err)
 			os.Exit(1)
 		}
+
+		if err := negotiateStartTLS(raw, *connectStartTLS, hostname); err != nil {
+			fmt.Fprintf(os.Stderr, "error negotiating STARTTLS: %v\n", err)
+			os.Exit(1)
+		}
+
+		var handshake handshakeInfo
+		tlsConfig, err := buildTLSConfig(connectTLSOptions{
+			MinVersion:   *connectMinVersion,
+			MaxVersion:   *connectMaxVersion,
+			Ciphers:      *connectCiphers,
+			Curves:       *connectCurves,
+			ALPN:         *connectALPN,
+			CertPath:     *connectCert,
+			KeyPath:      *connectKey,
+			CertPassword: *connectCertPass,
+		}, hostname, &handshake)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error building TLS config: %v\n", err)
+			os.Exit(1)
+		}
+
+		conn := tls.Client(raw, tlsConfig)
+		if err := conn.Handshake(); err != nil {
+			fmt.Fprintf(os.Stderr, "error connecting: %v\n", err)
+			os.Exit(1)
+		}
 		defer conn.Close()
+		summarizeHandshake(conn.ConnectionState(), &handshake)
+		result.Handshake = &handshake
 		for _, cert := range conn.ConnectionState().PeerCertificates {
 			if *connectPem {
 				pem.Encode(os.Stdout, lib.CertToPem(cert, nil))
@@ -123,13 +186,13 @@ func main() {
 		}
 
 		if !*connectPem {
-			var hostname string
-			if *connectName != "" {
-				hostname = *connectName
-			} else {
-				hostname = strings.Split(*connectTo, ":")[0]
+			opts := revocationOptions{
+				Mode:        revocationMode(*connectRevocation),
+				OCSPTimeout: *connectOCSPTimeout,
+				CacheDir:    crlCacheDir(),
+				StapledOCSP: conn.ConnectionState().OCSPResponse,
 			}
-			verifyResult := verifyChain(conn.ConnectionState().PeerCertificates, hostname, *connectCaPath)
+			verifyResult := verifyChainWithOptions(conn.ConnectionState().PeerCertificates, hostname, *connectCaPath, opts)
 			result.VerifyResult = &verifyResult
 		}
 
@@ -137,6 +200,7 @@ func main() {
 			blob, _ := json.Marshal(result)
 			fmt.Println(string(blob))
 		} else if !*connectPem {
+			printHandshakeInfo(handshake)
 			for i, cert := range result.Certificates {
 				fmt.Printf("** CERTIFICATE %d **\n", i+1)
 				displayCert(cert)
@@ -145,11 +209,8 @@ func main() {
 			printVerifyResult(*result.VerifyResult)
 		}
 	case verify.FullCommand():
-		file := inputFile(*verifyFile)
-		defer file.Close()
-
 		chain := []*x509.Certificate{}
-		lib.ReadCerts([]*os.File{file}, *verifyType, readPassword, func(block *pem.Block) {
+		onBlock := func(block *pem.Block) {
 			switch block.Type {
 			case "CERTIFICATE":
 				cert, err := x509.ParseCertificate(block.Bytes)
@@ -166,9 +227,26 @@ func main() {
 				}
 				chain = append(chain, certs...)
 			}
-		})
+		}
+
+		if uri, ok := pkcs11Arg(*verifyType, []string{*verifyFile}); ok {
+			uri.Module = firstNonEmpty(*verifyPKCS11Mod, uri.Module)
+			if err := lib.ReadPKCS11(uri, readPassword, onBlock); err != nil {
+				fmt.Fprintf(os.Stderr, "error reading PKCS#11 token: %s\n", err)
+				os.Exit(1)
+			}
+		} else {
+			file := inputFile(*verifyFile)
+			defer file.Close()
+			lib.ReadCerts([]*os.File{file}, *verifyType, readPassword, onBlock)
+		}
 
-		verifyResult := verifyChain(chain, *verifyName, *verifyCaPath)
+		opts := revocationOptions{
+			Mode:        revocationMode(*verifyRevocation),
+			OCSPTimeout: *verifyOCSPTimeout,
+			CacheDir:    crlCacheDir(),
+		}
+		verifyResult := verifyChainWithOptions(chain, *verifyName, *verifyCaPath, opts)
 		if *verifyJSON {
 			blob, _ := json.Marshal(verifyResult)
 			fmt.Println(string(blob))
@@ -178,7 +256,57 @@ func main() {
 		if verifyResult.Error != "" {
 			os.Exit(1)
 		}
+	case scan.FullCommand():
+		targets, err := parseTargetsFile(*scanTargetsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading targets file: %s\n", err)
+			os.Exit(1)
+		}
+
+		var previous map[string]string
+		if *scanDiffAgainst != "" {
+			previous, err = loadScanSnapshot(*scanDiffAgainst)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error reading --diff-against snapshot: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		results := runScan(targets, *scanConcurrency, *scanTimeout, *scanCaPath, previous, encoder)
+
+		if anyExpiringSoon(results, *scanExpiryThreshold) {
+			os.Exit(1)
+		}
+	}
+}
+
+// pkcs11Arg decides whether the given file arguments should be treated as a
+// PKCS#11 token URI rather than a path on disk: either --format=pkcs11 was
+// given, or the sole argument is itself a pkcs11: URI.
+func pkcs11Arg(format string, args []string) (*lib.PKCS11URI, bool) {
+	if len(args) != 1 || args[0] == "" {
+		return nil, false
+	}
+	if !strings.EqualFold(format, "pkcs11") && !lib.IsPKCS11URI(args[0]) {
+		return nil, false
+	}
+
+	uri, err := lib.ParsePKCS11URI(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error parsing pkcs11 URI: %s\n", err)
+		os.Exit(1)
+	}
+	return uri, true
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
 	}
+	return ""
 }
 
 func inputFile(fileName string) *os.File {
@@ -0,0 +1,65 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package pkcs7 extracts X.509 certificates out of PKCS#7 signed-data blobs,
+// the format most commonly produced by Java keytool and Windows certmgr.
+package pkcs7
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+)
+
+// contentInfo is the outermost ASN.1 structure of a PKCS#7 blob.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// signedData is the ContentInfo.Content payload for signed-data messages,
+// which is the only PKCS#7 content type certigo cares about.
+type signedData struct {
+	Version      int
+	Digests      asn1.RawValue
+	ContentInfo  asn1.RawValue
+	Certificates asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// ExtractCertificates pulls the X.509 certificates out of a DER-encoded
+// PKCS#7 signed-data structure.
+func ExtractCertificates(der []byte) ([]*x509.Certificate, error) {
+	var info contentInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, errors.New("pkcs7: unable to parse ContentInfo: " + err.Error())
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &sd); err != nil {
+		return nil, errors.New("pkcs7: unable to parse SignedData: " + err.Error())
+	}
+
+	if len(sd.Certificates.Bytes) == 0 {
+		return nil, errors.New("pkcs7: no certificates present in SignedData")
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, errors.New("pkcs7: unable to parse certificates: " + err.Error())
+	}
+
+	return certs, nil
+}
@@ -0,0 +1,135 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pkcs7
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// buildSignedData hand-assembles a minimal degenerate PKCS#7 SignedData
+// ContentInfo (no actual signature, just a certificate bag) wrapping certs,
+// the same shape keytool/certmgr produce when exporting a cert chain.
+func buildSignedData(t *testing.T, certs ...*x509.Certificate) []byte {
+	t.Helper()
+
+	var certBytes []byte
+	for _, cert := range certs {
+		certBytes = append(certBytes, cert.Raw...)
+	}
+
+	sd := signedData{
+		Version:      1,
+		Digests:      asn1.RawValue{FullBytes: []byte{0x31, 0x00}}, // empty SET
+		ContentInfo:  asn1.RawValue{FullBytes: []byte{0x30, 0x00}}, // empty SEQUENCE
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certBytes},
+	}
+	sdBytes, err := asn1.Marshal(sd)
+	if err != nil {
+		t.Fatalf("marshal signedData: %s", err)
+	}
+
+	info := contentInfo{
+		ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}, // signedData
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, FullBytes: wrapExplicit(sdBytes)},
+	}
+	der, err := asn1.Marshal(info)
+	if err != nil {
+		t.Fatalf("marshal contentInfo: %s", err)
+	}
+	return der
+}
+
+// wrapExplicit wraps content in an explicit [0] tag, as ContentInfo.Content
+// requires.
+func wrapExplicit(content []byte) []byte {
+	wrapped, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content})
+	if err != nil {
+		panic(err)
+	}
+	return wrapped
+}
+
+func selfSignedCert(t *testing.T, commonName string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %s", err)
+	}
+	return cert
+}
+
+func TestExtractCertificates(t *testing.T) {
+	leaf := selfSignedCert(t, "leaf.example.com")
+	intermediate := selfSignedCert(t, "intermediate.example.com")
+
+	der := buildSignedData(t, leaf, intermediate)
+
+	certs, err := ExtractCertificates(der)
+	if err != nil {
+		t.Fatalf("ExtractCertificates() error = %s", err)
+	}
+	if len(certs) != 2 {
+		t.Fatalf("ExtractCertificates() returned %d certs, want 2", len(certs))
+	}
+	if certs[0].Subject.CommonName != "leaf.example.com" {
+		t.Errorf("certs[0].Subject.CommonName = %q, want leaf.example.com", certs[0].Subject.CommonName)
+	}
+	if certs[1].Subject.CommonName != "intermediate.example.com" {
+		t.Errorf("certs[1].Subject.CommonName = %q, want intermediate.example.com", certs[1].Subject.CommonName)
+	}
+}
+
+func TestExtractCertificatesErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		der  []byte
+	}{
+		{"empty", nil},
+		{"not asn1", []byte("not a certificate")},
+		{"no certificates", buildSignedData(t)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ExtractCertificates(tc.der); err == nil {
+				t.Fatal("ExtractCertificates() error = nil, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// revocationMode selects which revocation-checking mechanisms verifyChain is
+// allowed to use, as chosen by --check-revocation.
+type revocationMode string
+
+const (
+	revocationNone revocationMode = "none"
+	revocationOCSP revocationMode = "ocsp"
+	revocationCRL  revocationMode = "crl"
+	revocationBoth revocationMode = "both"
+)
+
+// revocationStatus is the outcome of checking a single certificate.
+type revocationStatus string
+
+const (
+	revocationGood    revocationStatus = "good"
+	revocationRevoked revocationStatus = "revoked"
+	revocationUnknown revocationStatus = "unknown"
+)
+
+// revocationOptions controls how checkChainRevocation behaves.
+type revocationOptions struct {
+	Mode        revocationMode
+	OCSPTimeout time.Duration
+	CacheDir    string
+	StapledOCSP []byte // response from tls.ConnectionState.OCSPResponse, if any
+}
+
+// defaultRevocationOptions is what verify uses when the operator hasn't set
+// any revocation flags: check both OCSP and CRL, five second OCSP timeout,
+// and cache CRLs under the user's cache directory.
+func defaultRevocationOptions() revocationOptions {
+	return revocationOptions{
+		Mode:        revocationBoth,
+		OCSPTimeout: 5 * time.Second,
+		CacheDir:    crlCacheDir(),
+	}
+}
+
+// revocationResult is the per-certificate revocation-status entry surfaced
+// in VerifyResult.Revocations.
+type revocationResult struct {
+	SerialNumber string           `json:"serial"`
+	Status       revocationStatus `json:"status"`
+	Source       string           `json:"source,omitempty"` // "ocsp", "crl", or "stapled"
+	Reason       string           `json:"reason,omitempty"`
+	CheckedAt    time.Time        `json:"checked_at"`
+	ProducedAt   time.Time        `json:"produced_at,omitempty"`
+}
+
+// checkChainRevocation checks the revocation status of every certificate in
+// chain (except the root) against its issuer, which is the next certificate
+// up the chain.
+func checkChainRevocation(chain []*x509.Certificate, opts revocationOptions) []revocationResult {
+	results := make([]revocationResult, 0, len(chain)-1)
+	for i := 0; i < len(chain)-1; i++ {
+		cert, issuer := chain[i], chain[i+1]
+		results = append(results, checkCertRevocation(cert, issuer, opts))
+	}
+	return results
+}
+
+// checkCertRevocation checks cert (issued by issuer) for revocation, trying
+// OCSP first (or the stapled response, if present and for this cert) and
+// falling back to CRL per opts.Mode.
+func checkCertRevocation(cert, issuer *x509.Certificate, opts revocationOptions) revocationResult {
+	now := time.Now()
+
+	if len(opts.StapledOCSP) > 0 {
+		if result, ok := parseOCSPResponse(opts.StapledOCSP, cert, issuer, "stapled", now); ok && result.Status != revocationUnknown {
+			return result
+		}
+	}
+
+	if opts.Mode == revocationOCSP || opts.Mode == revocationBoth {
+		if result, ok := checkOCSP(cert, issuer, opts, now); ok {
+			return result
+		}
+	}
+
+	if opts.Mode == revocationCRL || opts.Mode == revocationBoth {
+		if result, ok := checkCRL(cert, issuer, opts, now); ok {
+			return result
+		}
+	}
+
+	return revocationResult{
+		SerialNumber: cert.SerialNumber.String(),
+		Status:       revocationUnknown,
+		CheckedAt:    now,
+		Reason:       "no revocation source available",
+	}
+}
+
+// checkOCSP issues an OCSP request for cert against issuer and parses the
+// response. ok is false if the responder couldn't be reached or timed out,
+// signaling the caller should fall back to CRL.
+func checkOCSP(cert, issuer *x509.Certificate, opts revocationOptions, now time.Time) (revocationResult, bool) {
+	if len(cert.OCSPServer) == 0 {
+		return revocationResult{}, false
+	}
+
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return revocationResult{}, false
+	}
+
+	client := &http.Client{Timeout: opts.OCSPTimeout}
+	resp, err := client.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return revocationResult{}, false
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return revocationResult{}, false
+	}
+
+	result, ok := parseOCSPResponse(body, cert, issuer, "ocsp", now)
+	if !ok || result.Status == revocationUnknown {
+		return result, false
+	}
+	return result, true
+}
+
+// parseOCSPResponse decodes an OCSP response (stapled or fetched live) into
+// a revocationResult. ok is false if the response doesn't parse or doesn't
+// cover cert.
+func parseOCSPResponse(der []byte, cert, issuer *x509.Certificate, source string, now time.Time) (revocationResult, bool) {
+	resp, err := ocsp.ParseResponseForCert(der, cert, issuer)
+	if err != nil {
+		return revocationResult{}, false
+	}
+
+	result := revocationResult{
+		SerialNumber: cert.SerialNumber.String(),
+		Source:       source,
+		CheckedAt:    now,
+		ProducedAt:   resp.ProducedAt,
+	}
+
+	switch resp.Status {
+	case ocsp.Good:
+		result.Status = revocationGood
+	case ocsp.Revoked:
+		result.Status = revocationRevoked
+		result.Reason = revocationReasonString(resp.RevocationReason)
+	default:
+		result.Status = revocationUnknown
+	}
+	return result, true
+}
+
+// checkCRL downloads (or reuses a cached copy of) the CRL named in cert's
+// CRLDistributionPoints extension and checks whether cert's serial is on it.
+func checkCRL(cert, issuer *x509.Certificate, opts revocationOptions, now time.Time) (revocationResult, bool) {
+	if len(cert.CRLDistributionPoints) == 0 {
+		return revocationResult{}, false
+	}
+
+	url := cert.CRLDistributionPoints[0]
+	crl, err := fetchCRL(url, issuer, opts)
+	if err != nil {
+		return revocationResult{}, false
+	}
+
+	result := revocationResult{
+		SerialNumber: cert.SerialNumber.String(),
+		Source:       "crl",
+		CheckedAt:    now,
+		Status:       revocationGood,
+	}
+
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			result.Status = revocationRevoked
+			result.Reason = "present in CRL"
+			break
+		}
+	}
+	return result, true
+}
+
+// fetchCRL returns the parsed CRL for url, using the on-disk cache in
+// opts.CacheDir (keyed by issuer SKID + URL) when it's still within its
+// NextUpdate window.
+func fetchCRL(url string, issuer *x509.Certificate, opts revocationOptions) (*pkix.CertificateList, error) {
+	cachePath := crlCachePath(opts.CacheDir, issuer, url)
+
+	if cached, err := readCachedCRL(cachePath, issuer); err == nil {
+		return cached, nil
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	der, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	crl, err := x509.ParseCRL(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := issuer.CheckCRLSignature(crl); err != nil {
+		return nil, fmt.Errorf("CRL from %s is not signed by %s: %s", url, issuer.Subject, err)
+	}
+
+	writeCachedCRL(cachePath, der)
+	return crl, nil
+}
+
+// readCachedCRL returns the cached CRL at path, as long as it's signed by
+// issuer and hasn't passed its NextUpdate time.
+func readCachedCRL(path string, issuer *x509.Certificate) (*pkix.CertificateList, error) {
+	der, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	crl, err := x509.ParseCRL(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := issuer.CheckCRLSignature(crl); err != nil {
+		return nil, fmt.Errorf("cached CRL at %s is not signed by %s: %s", path, issuer.Subject, err)
+	}
+	if crl.TBSCertList.NextUpdate.Before(time.Now()) {
+		return nil, fmt.Errorf("cached CRL at %s has expired", path)
+	}
+	return crl, nil
+}
+
+func writeCachedCRL(path string, der []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	_ = ioutil.WriteFile(path, der, 0644)
+}
+
+// crlCachePath keys a cache entry by the issuer's subject key identifier and
+// the distribution point URL, so re-issued CRLs for the same CA don't
+// collide with a previous cache entry at a stale URL.
+func crlCachePath(dir string, issuer *x509.Certificate, url string) string {
+	h := sha256.Sum256(append(issuer.SubjectKeyId, []byte(url)...))
+	return filepath.Join(dir, hex.EncodeToString(h[:])+".crl")
+}
+
+func crlCacheDir() string {
+	dir := os.Getenv("CERTIGO_CACHE_DIR")
+	if dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "certigo-crl-cache")
+	}
+	return filepath.Join(home, ".cache", "certigo", "crl")
+}
+
+func revocationReasonString(code int) string {
+	reasons := map[int]string{
+		ocsp.Unspecified:          "unspecified",
+		ocsp.KeyCompromise:        "key compromise",
+		ocsp.CACompromise:         "ca compromise",
+		ocsp.AffiliationChanged:   "affiliation changed",
+		ocsp.Superseded:           "superseded",
+		ocsp.CessationOfOperation: "cessation of operation",
+		ocsp.CertificateHold:      "certificate hold",
+		ocsp.RemoveFromCRL:        "remove from crl",
+	}
+	if reason, ok := reasons[code]; ok {
+		return reason
+	}
+	return fmt.Sprintf("unknown (%d)", code)
+}
@@ -0,0 +1,236 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestRevocationReasonString(t *testing.T) {
+	for _, tc := range []struct {
+		code int
+		want string
+	}{
+		{ocsp.KeyCompromise, "key compromise"},
+		{ocsp.CertificateHold, "certificate hold"},
+		{99, "unknown (99)"},
+	} {
+		if got := revocationReasonString(tc.code); got != tc.want {
+			t.Errorf("revocationReasonString(%d) = %q, want %q", tc.code, got, tc.want)
+		}
+	}
+}
+
+func TestCRLCachePath(t *testing.T) {
+	issuerA := &x509.Certificate{SubjectKeyId: []byte{0x01, 0x02}}
+	issuerB := &x509.Certificate{SubjectKeyId: []byte{0x03, 0x04}}
+
+	pathA := crlCachePath("/cache", issuerA, "http://example.com/a.crl")
+	pathB := crlCachePath("/cache", issuerB, "http://example.com/a.crl")
+	if pathA == pathB {
+		t.Errorf("crlCachePath gave the same path for different issuers: %s", pathA)
+	}
+
+	pathSame := crlCachePath("/cache", issuerA, "http://example.com/a.crl")
+	if pathA != pathSame {
+		t.Errorf("crlCachePath is not deterministic: %s != %s", pathA, pathSame)
+	}
+	if filepath.Dir(pathA) != "/cache" {
+		t.Errorf("crlCachePath(%q, ...) = %q, want it rooted under /cache", "/cache", pathA)
+	}
+
+	pathURL := crlCachePath("/cache", issuerA, "http://example.com/b.crl")
+	if pathA == pathURL {
+		t.Errorf("crlCachePath gave the same path for different URLs: %s", pathA)
+	}
+}
+
+// issuerWithOCSPResponse builds a self-signed CA and a leaf it issued, plus a
+// signed OCSP response (from the CA, as its own responder) for the leaf with
+// the given status.
+func issuerWithOCSPResponse(t *testing.T, status int) (leaf, issuer *x509.Certificate, der []byte) {
+	t.Helper()
+
+	issuerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate issuer key: %s", err)
+	}
+	issuerTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	issuerDER, err := x509.CreateCertificate(rand.Reader, issuerTemplate, issuerTemplate, &issuerKey.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatalf("create issuer certificate: %s", err)
+	}
+	issuer, err = x509.ParseCertificate(issuerDER)
+	if err != nil {
+		t.Fatalf("parse issuer certificate: %s", err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate leaf key: %s", err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "leaf.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, issuerTemplate, &leafKey.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatalf("create leaf certificate: %s", err)
+	}
+	leaf, err = x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatalf("parse leaf certificate: %s", err)
+	}
+
+	der, err = ocsp.CreateResponse(issuer, issuer, ocsp.Response{
+		Status:       status,
+		SerialNumber: leaf.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   time.Now().Add(time.Hour),
+	}, issuerKey)
+	if err != nil {
+		t.Fatalf("create OCSP response: %s", err)
+	}
+	return leaf, issuer, der
+}
+
+// TestCheckCertRevocationFallsThroughUnknownStapled ensures a stapled OCSP
+// response that parses fine but reports an Unknown status doesn't
+// short-circuit checkCertRevocation -- it must still fall through to live
+// OCSP/CRL, just as checkOCSP already did for a freshly-fetched Unknown
+// response.
+func TestCheckCertRevocationFallsThroughUnknownStapled(t *testing.T) {
+	leaf, issuer, der := issuerWithOCSPResponse(t, ocsp.Unknown)
+
+	opts := revocationOptions{
+		Mode:        revocationNone,
+		StapledOCSP: der,
+	}
+
+	result := checkCertRevocation(leaf, issuer, opts)
+	if result.Status != revocationUnknown {
+		t.Fatalf("checkCertRevocation() status = %q, want %q", result.Status, revocationUnknown)
+	}
+	if result.Source == "stapled" {
+		t.Errorf("checkCertRevocation() returned the stapled result even though its status was Unknown; the stapled branch should have fallen through")
+	}
+}
+
+// TestCheckCertRevocationUsesGoodStapled is the companion case: a stapled
+// response with a definite Good status should be returned as-is.
+func TestCheckCertRevocationUsesGoodStapled(t *testing.T) {
+	leaf, issuer, der := issuerWithOCSPResponse(t, ocsp.Good)
+
+	opts := revocationOptions{
+		Mode:        revocationNone,
+		StapledOCSP: der,
+	}
+
+	result := checkCertRevocation(leaf, issuer, opts)
+	if result.Status != revocationGood {
+		t.Fatalf("checkCertRevocation() status = %q, want %q", result.Status, revocationGood)
+	}
+	if result.Source != "stapled" {
+		t.Errorf("checkCertRevocation() source = %q, want %q", result.Source, "stapled")
+	}
+}
+
+// TestFetchCRLVerifiesSignature ensures fetchCRL rejects a CRL that doesn't
+// carry a valid signature from issuer -- otherwise a MITM'd or forged
+// distribution point could serve an empty CRL and have it trusted outright.
+func TestFetchCRLVerifiesSignature(t *testing.T) {
+	issuerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate issuer key: %s", err)
+	}
+	issuerTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "crl test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	issuerDER, err := x509.CreateCertificate(rand.Reader, issuerTemplate, issuerTemplate, &issuerKey.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatalf("create issuer certificate: %s", err)
+	}
+	issuer, err := x509.ParseCertificate(issuerDER)
+	if err != nil {
+		t.Fatalf("parse issuer certificate: %s", err)
+	}
+
+	forgerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate forger key: %s", err)
+	}
+
+	validCRL, err := issuer.CreateCRL(rand.Reader, issuerKey, nil, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("create correctly-signed CRL: %s", err)
+	}
+	// forgedCRL claims to be issued by issuer (same Issuer name) but is
+	// signed by an unrelated key, simulating a MITM'd or forged CRL.
+	forgedCRL, err := issuer.CreateCRL(rand.Reader, forgerKey, nil, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("create forged CRL: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		der     []byte
+		wantErr bool
+	}{
+		{"correctly signed", validCRL, false},
+		{"forged signature", forgedCRL, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(tc.der)
+			}))
+			defer server.Close()
+
+			opts := revocationOptions{CacheDir: t.TempDir()}
+			_, err := fetchCRL(server.URL, issuer, opts)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("fetchCRL() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scanTarget is one line of a scan targets file: a host:port to connect to,
+// plus whatever per-target overrides the operator gave it.
+type scanTarget struct {
+	Address      string
+	SNI          string
+	StartTLS     string
+	ExpectedName string
+}
+
+// scanResult is the JSON object scan emits once per target, one per line.
+type scanResult struct {
+	Target  string      `json:"target"`
+	Error   string      `json:"error,omitempty"`
+	RTT     rttMilliDur `json:"rtt_ms,omitempty"`
+	Changed bool        `json:"fingerprint_changed,omitempty"`
+	simpleResult
+}
+
+// rttMilliDur is a time.Duration that marshals as whole milliseconds, since
+// time.Duration's default JSON encoding is nanoseconds and "rtt_ms" would
+// otherwise be mislabeled by a factor of 1e6.
+type rttMilliDur time.Duration
+
+func (d rttMilliDur) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).Milliseconds())
+}
+
+// parseTargetsFile reads a scan targets file: one target per line, blank lines
+// and lines starting with '#' ignored, in the form
+//
+//	host:port [sni=<name>] [starttls=<proto>] [name=<expected>]
+func parseTargetsFile(path string) ([]scanTarget, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var targets []scanTarget
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		target := scanTarget{Address: fields[0]}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "sni":
+				target.SNI = kv[1]
+			case "starttls":
+				target.StartTLS = kv[1]
+			case "name":
+				target.ExpectedName = kv[1]
+			}
+		}
+		targets = append(targets, target)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// scanOne dials, optionally STARTTLSes, and completes a TLS handshake
+// against target, producing the same simpleResult shape connect does.
+func scanOne(target scanTarget, caPath string, timeout time.Duration) scanResult {
+	result := scanResult{Target: target.Address}
+
+	hostname := target.SNI
+	if hostname == "" {
+		hostname = strings.Split(target.Address, ":")[0]
+	}
+	expectedName := target.ExpectedName
+	if expectedName == "" {
+		expectedName = hostname
+	}
+
+	start := time.Now()
+	raw, err := net.DialTimeout("tcp", target.Address, timeout)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(timeout))
+
+	if err := negotiateStartTLS(raw, target.StartTLS, hostname); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	conn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true, ServerName: hostname})
+	if err := conn.Handshake(); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.RTT = rttMilliDur(time.Since(start))
+
+	for _, cert := range conn.ConnectionState().PeerCertificates {
+		result.Certificates = append(result.Certificates, createSimpleCertificate(certWithName{cert: cert}))
+	}
+
+	opts := revocationOptions{Mode: revocationNone}
+	verifyResult := verifyChainWithOptions(conn.ConnectionState().PeerCertificates, expectedName, caPath, opts)
+	result.VerifyResult = &verifyResult
+
+	return result
+}
+
+// runScan fans targets out across a bounded worker pool and streams each
+// scanResult to out as soon as it completes, JSON-encoded one per line.
+// previous, if non-nil, is consulted to flag fingerprint changes.
+func runScan(targets []scanTarget, concurrency int, timeout time.Duration, caPath string, previous map[string]string, out *json.Encoder) []scanResult {
+	jobs := make(chan scanTarget)
+	results := make(chan scanResult)
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range jobs {
+				results <- scanOne(target, caPath, timeout)
+			}
+		}()
+	}
+
+	go func() {
+		for _, target := range targets {
+			jobs <- target
+		}
+		close(jobs)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var all []scanResult
+	for result := range results {
+		if previous != nil && len(result.Certificates) > 0 {
+			if prior, ok := previous[result.Target]; ok {
+				result.Changed = prior != result.Certificates[0].SHA256Fingerprint
+			}
+		}
+		out.Encode(result)
+		all = append(all, result)
+	}
+	return all
+}
+
+// loadScanSnapshot reads a previous scan's JSONL output and returns a map of
+// target -> leaf SHA-256 fingerprint, for --diff-against.
+func loadScanSnapshot(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	snapshot := map[string]string{}
+	decoder := json.NewDecoder(f)
+	for decoder.More() {
+		var result scanResult
+		if err := decoder.Decode(&result); err != nil {
+			return nil, err
+		}
+		if len(result.Certificates) > 0 {
+			snapshot[result.Target] = result.Certificates[0].SHA256Fingerprint
+		}
+	}
+	return snapshot, nil
+}
+
+// anyExpiringSoon reports whether any leaf certificate across results
+// expires before threshold from now.
+func anyExpiringSoon(results []scanResult, threshold time.Duration) bool {
+	cutoff := time.Now().Add(threshold)
+	for _, result := range results {
+		if len(result.Certificates) == 0 {
+			continue
+		}
+		if result.Certificates[0].NotAfter.Before(cutoff) {
+			return true
+		}
+	}
+	return false
+}
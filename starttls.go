@@ -0,0 +1,307 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// negotiateStartTLS speaks whatever plaintext preamble proto requires to get
+// the server to agree to start TLS on conn, so the caller can go on to wrap
+// conn in tls.Client. host is used where the protocol needs the server name
+// up front (SMTP/XMPP's initial greeting).
+func negotiateStartTLS(conn net.Conn, proto string, host string) error {
+	switch proto {
+	case "":
+		return nil
+	case "smtp":
+		return startTLSSMTP(conn, host)
+	case "imap":
+		return startTLSIMAP(conn)
+	case "pop3":
+		return startTLSPOP3(conn)
+	case "ftp":
+		return startTLSFTP(conn)
+	case "xmpp":
+		return startTLSXMPP(conn, host)
+	case "postgres":
+		return startTLSPostgres(conn)
+	case "mysql":
+		return startTLSMySQL(conn)
+	case "ldap":
+		return startTLSLDAP(conn)
+	default:
+		return fmt.Errorf("unsupported --start-tls protocol %q", proto)
+	}
+}
+
+func startTLSSMTP(conn net.Conn, host string) error {
+	text := textproto.NewConn(conn)
+	if _, _, err := text.ReadResponse(220); err != nil {
+		return fmt.Errorf("smtp: bad greeting: %s", err)
+	}
+	id, err := text.Cmd("EHLO %s", host)
+	if err != nil {
+		return err
+	}
+	text.StartResponse(id)
+	if _, _, err := text.ReadResponse(250); err != nil {
+		text.EndResponse(id)
+		return fmt.Errorf("smtp: EHLO failed: %s", err)
+	}
+	text.EndResponse(id)
+
+	id, err = text.Cmd("STARTTLS")
+	if err != nil {
+		return err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	if _, _, err := text.ReadResponse(220); err != nil {
+		return fmt.Errorf("smtp: STARTTLS refused: %s", err)
+	}
+	return nil
+}
+
+func startTLSIMAP(conn net.Conn) error {
+	text := textproto.NewConn(conn)
+	if _, err := text.ReadLine(); err != nil { // untagged greeting
+		return fmt.Errorf("imap: bad greeting: %s", err)
+	}
+	id, err := text.Cmd("a1 STARTTLS")
+	if err != nil {
+		return err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	line, err := text.ReadLine()
+	if err != nil {
+		return fmt.Errorf("imap: STARTTLS failed: %s", err)
+	}
+	if !strings.HasPrefix(line, "a1 OK") {
+		return fmt.Errorf("imap: STARTTLS refused: %s", line)
+	}
+	return nil
+}
+
+func startTLSPOP3(conn net.Conn) error {
+	text := textproto.NewConn(conn)
+	if _, err := text.ReadLine(); err != nil {
+		return fmt.Errorf("pop3: bad greeting: %s", err)
+	}
+	id, err := text.Cmd("STLS")
+	if err != nil {
+		return err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	line, err := text.ReadLine()
+	if err != nil || len(line) == 0 || line[0] != '+' {
+		return fmt.Errorf("pop3: STLS refused: %s", line)
+	}
+	return nil
+}
+
+func startTLSFTP(conn net.Conn) error {
+	text := textproto.NewConn(conn)
+	if _, _, err := text.ReadResponse(220); err != nil {
+		return fmt.Errorf("ftp: bad greeting: %s", err)
+	}
+	id, err := text.Cmd("AUTH TLS")
+	if err != nil {
+		return err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	if _, _, err := text.ReadResponse(234); err != nil {
+		return fmt.Errorf("ftp: AUTH TLS refused: %s", err)
+	}
+	return nil
+}
+
+func startTLSXMPP(conn net.Conn, host string) error {
+	open := fmt.Sprintf("<?xml version='1.0'?><stream:stream to='%s' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>", host)
+	if _, err := conn.Write([]byte(open)); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte("<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")); err != nil {
+		return err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return fmt.Errorf("xmpp: no response to STARTTLS: %s", err)
+	}
+	if !contains(buf[:n], "<proceed") {
+		return fmt.Errorf("xmpp: server did not proceed with TLS: %s", buf[:n])
+	}
+	return nil
+}
+
+func contains(haystack []byte, needle string) bool {
+	return len(haystack) >= len(needle) && indexOf(haystack, needle) >= 0
+}
+
+func indexOf(haystack []byte, needle string) int {
+	n := len(needle)
+	for i := 0; i+n <= len(haystack); i++ {
+		if string(haystack[i:i+n]) == needle {
+			return i
+		}
+	}
+	return -1
+}
+
+// startTLSPostgres sends an SSLRequest packet (RFC message with the special
+// 80877103 code) and expects a single 'S' byte back before TLS can start.
+func startTLSPostgres(conn net.Conn) error {
+	req := []byte{0, 0, 0, 8, 4, 210, 22, 47}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 1)
+	if _, err := conn.Read(resp); err != nil {
+		return fmt.Errorf("postgres: no response to SSLRequest: %s", err)
+	}
+	if resp[0] != 'S' {
+		return fmt.Errorf("postgres: server refused SSLRequest")
+	}
+	return nil
+}
+
+// startTLSMySQL reads the server's initial (protocol 10) handshake packet,
+// checks that it advertises CLIENT_SSL, then sends a minimal SSLRequest
+// packet (protocol 10 handshake response with no username/auth, just the
+// client capability flags) to ask it to switch to TLS.
+func startTLSMySQL(conn net.Conn) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("mysql: no handshake packet: %s", err)
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	body := make([]byte, length)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return fmt.Errorf("mysql: short handshake packet: %s", err)
+	}
+
+	if err := requireMySQLClientSSL(body); err != nil {
+		return err
+	}
+
+	const clientSSL = 0x00000800
+	const clientProtocol41 = 0x00000200
+	capabilities := uint32(clientSSL | clientProtocol41)
+
+	sslRequest := make([]byte, 4+32)
+	sslRequest[4] = byte(capabilities)
+	sslRequest[5] = byte(capabilities >> 8)
+	sslRequest[6] = byte(capabilities >> 16)
+	sslRequest[7] = byte(capabilities >> 24)
+	sslRequest[8] = 0xff // max packet size placeholder
+	sslRequest[12] = 33  // character set: utf8_general_ci
+
+	payloadLen := len(sslRequest) - 4
+	sslRequest[0] = byte(payloadLen)
+	sslRequest[1] = byte(payloadLen >> 8)
+	sslRequest[2] = byte(payloadLen >> 16)
+	sslRequest[3] = 1 // sequence id follows server's greeting (0)
+
+	_, err := conn.Write(sslRequest)
+	return err
+}
+
+// requireMySQLClientSSL parses just enough of a protocol 10 initial
+// handshake packet body to read capability_flags_1, and errors out if the
+// server hasn't set CLIENT_SSL -- sending an SSLRequest to a server that
+// never advertised TLS support would just hang waiting for a handshake that
+// never comes.
+func requireMySQLClientSSL(body []byte) error {
+	const clientSSL = 0x0800 // fits in capability_flags_1 (the lower 16 bits)
+
+	offset := 1 // protocol_version
+	versionEnd := bytes.IndexByte(body[offset:], 0)
+	if versionEnd < 0 {
+		return fmt.Errorf("mysql: handshake packet has no server version")
+	}
+	offset += versionEnd + 1 // server_version + its NUL terminator
+	offset += 4              // thread_id
+	offset += 8              // auth_plugin_data_part_1
+	offset += 1              // filler
+	if offset+2 > len(body) {
+		return fmt.Errorf("mysql: handshake packet too short to contain capability flags")
+	}
+	capabilityFlags1 := uint16(body[offset]) | uint16(body[offset+1])<<8
+
+	if capabilityFlags1&clientSSL == 0 {
+		return fmt.Errorf("mysql: server does not advertise CLIENT_SSL")
+	}
+	return nil
+}
+
+// startTLSLDAP issues the StartTLS extended operation (OID
+// 1.3.6.1.4.1.1466.20037) and waits for a success response.
+func startTLSLDAP(conn net.Conn) error {
+	// ExtendedRequest [APPLICATION 23] { requestName [0] "1.3.6.1.4.1.1466.20037" }
+	// wrapped in an LDAPMessage with messageID 1, hand-encoded since
+	// pulling in a full BER/LDAP library just for this handshake isn't
+	// worth it.
+	oid := "1.3.6.1.4.1.1466.20037"
+	req := []byte{
+		0x30, byte(7 + len(oid)), // LDAPMessage SEQUENCE: messageID (3) + ExtendedRequest TLV (4+len(oid))
+		0x02, 0x01, 0x01, // messageID INTEGER 1
+		0x77, byte(2 + len(oid)), // [APPLICATION 23] ExtendedRequest
+		0x80, byte(len(oid)), // [0] requestName
+	}
+	req = append(req, []byte(oid)...)
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 4096)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return fmt.Errorf("ldap: no response to StartTLS: %s", err)
+	}
+	// A successful ExtendedResponse carries a resultCode of 0 (success) as
+	// its first ENUMERATED value; we look for the success marker rather
+	// than fully parsing the response.
+	if !containsBytes(resp[:n], []byte{0x0a, 0x01, 0x00}) {
+		return fmt.Errorf("ldap: StartTLS was not accepted")
+	}
+	return nil
+}
+
+func containsBytes(haystack, needle []byte) bool {
+	for i := 0; i+len(needle) <= len(haystack); i++ {
+		match := true
+		for j := range needle {
+			if haystack[i+j] != needle[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/asn1"
+	"net"
+	"testing"
+	"time"
+)
+
+// slowConn wraps a net.Conn but returns at most one byte per Read, to
+// exercise callers that must tolerate short reads from the network.
+type slowConn struct {
+	net.Conn
+}
+
+func (c slowConn) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return c.Conn.Read(b)
+}
+
+func TestStartTLSPostgres(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		reply   byte
+		wantErr bool
+	}{
+		{"accepted", 'S', false},
+		{"refused", 'N', true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			done := make(chan error, 1)
+			go func() { done <- startTLSPostgres(client) }()
+
+			req := make([]byte, 8)
+			if _, err := server.Read(req); err != nil {
+				t.Fatalf("server did not receive SSLRequest: %s", err)
+			}
+			want := []byte{0, 0, 0, 8, 4, 210, 22, 47}
+			for i := range want {
+				if req[i] != want[i] {
+					t.Fatalf("SSLRequest byte %d = %#x, want %#x", i, req[i], want[i])
+				}
+			}
+			server.Write([]byte{tc.reply})
+
+			err := <-done
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("startTLSPostgres() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// mysqlHandshakeBody builds a fake protocol-10 initial handshake packet
+// body: protocol_version, a NUL-terminated server_version, thread_id,
+// auth_plugin_data_part_1, a filler byte, then capability_flags_1 with (or
+// without) the CLIENT_SSL bit set.
+func mysqlHandshakeBody(clientSSL bool) []byte {
+	body := append([]byte{10}, []byte("5.7.0\x00")...) // protocol_version, server_version
+	body = append(body, 1, 0, 0, 0)                     // thread_id
+	body = append(body, make([]byte, 8)...)             // auth_plugin_data_part_1
+	body = append(body, 0)                              // filler
+	if clientSSL {
+		body = append(body, 0x00, 0x08) // capability_flags_1: CLIENT_SSL set
+	} else {
+		body = append(body, 0x00, 0x00) // capability_flags_1: CLIENT_SSL unset
+	}
+	return body
+}
+
+func TestStartTLSMySQLHandlesShortReads(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// The handshake packet is trickled in one byte at a time by slowConn to
+	// simulate a fragmented TCP read.
+	body := mysqlHandshakeBody(true)
+	header := []byte{byte(len(body)), 0, 0, 0}
+
+	go func() {
+		server.Write(header)
+		time.Sleep(5 * time.Millisecond)
+		server.Write(body)
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- startTLSMySQL(slowConn{client}) }()
+
+	// Drain the SSLRequest packet the client sends back so the handshake
+	// goroutine can return.
+	go func() {
+		buf := make([]byte, 64)
+		server.Read(buf)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("startTLSMySQL() with fragmented reads: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("startTLSMySQL() did not return; short read likely wasn't fully consumed")
+	}
+}
+
+func TestStartTLSMySQLRequiresClientSSL(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	body := mysqlHandshakeBody(false)
+	header := []byte{byte(len(body)), 0, 0, 0}
+
+	go func() {
+		server.Write(header)
+		server.Write(body)
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- startTLSMySQL(client) }()
+
+	err := <-done
+	if err == nil {
+		t.Fatal("startTLSMySQL() error = nil, want error for a server that doesn't advertise CLIENT_SSL")
+	}
+}
+
+func TestStartTLSLDAPRequestIsSelfConsistent(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- startTLSLDAP(client) }()
+
+	req := make([]byte, 64)
+	n, err := server.Read(req)
+	if err != nil {
+		t.Fatalf("server did not receive StartTLS request: %s", err)
+	}
+	req = req[:n]
+
+	// The outer LDAPMessage SEQUENCE's declared length must match the
+	// number of bytes that actually follow the length octet -- this is
+	// exactly the invariant the original off-by-5 bug violated.
+	var msg asn1.RawValue
+	if _, err := asn1.Unmarshal(req, &msg); err != nil {
+		t.Fatalf("StartTLS request is not a well-formed SEQUENCE: %s\n%x", err, req)
+	}
+	if len(msg.Bytes) != len(req)-2 {
+		t.Fatalf("declared content length %d does not match actual content length %d", len(msg.Bytes), len(req)-2)
+	}
+
+	server.Write([]byte{0x30, 0x08, 0x0a, 0x01, 0x00, 0x04, 0x00, 0x04, 0x00})
+	if err := <-done; err != nil {
+		t.Fatalf("startTLSLDAP() with success response: %s", err)
+	}
+}
+
+func TestStartTLSIMAP(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		greeting string
+		reply    string
+		wantErr  bool
+	}{
+		{"accepted", "* OK IMAP4rev1 ready\r\n", "a1 OK STARTTLS completed\r\n", false},
+		{"refused", "* OK IMAP4rev1 ready\r\n", "a1 NO STARTTLS failed\r\n", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			done := make(chan error, 1)
+			go func() { done <- startTLSIMAP(client) }()
+
+			go func() {
+				server.Write([]byte(tc.greeting))
+				reader := bufio.NewReader(server)
+				reader.ReadString('\n') // consume "a1 STARTTLS"
+				server.Write([]byte(tc.reply))
+			}()
+
+			err := <-done
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("startTLSIMAP() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
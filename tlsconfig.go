@@ -0,0 +1,213 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"p256":   tls.CurveP256,
+	"p384":   tls.CurveP384,
+	"p521":   tls.CurveP521,
+	"x25519": tls.X25519,
+}
+
+// cipherSuitesByName covers the suites operators are most likely to name on
+// the command line when debugging a handshake; anything more exotic can
+// still be selected by the Go runtime's own defaults.
+var cipherSuitesByName = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// connectTLSOptions is the set of --connect flags that affect how the TLS
+// handshake itself is performed, separate from the chain-verification flags
+// handled by revocationOptions.
+type connectTLSOptions struct {
+	MinVersion   string
+	MaxVersion   string
+	Ciphers      []string
+	Curves       []string
+	ALPN         []string
+	CertPath     string
+	KeyPath      string
+	CertPassword string
+}
+
+// handshakeInfo captures the negotiated parameters of a completed TLS
+// connection, for reporting alongside the certificate chain.
+type handshakeInfo struct {
+	Version             string   `json:"version"`
+	CipherSuite         string   `json:"cipher_suite"`
+	NegotiatedProtocol  string   `json:"alpn_protocol,omitempty"`
+	Curve               string   `json:"curve"`
+	ClientCertRequested bool     `json:"client_cert_requested"`
+	AcceptableClientCAs []string `json:"acceptable_client_cas,omitempty"`
+}
+
+// curveNotExposed is reported for Curve when crypto/tls's ConnectionState
+// doesn't surface which curve was negotiated for the key exchange -- the
+// standard library treats that as an internal handshake detail, so we say so
+// explicitly rather than silently dropping the --curve deliverable.
+const curveNotExposed = "unknown (crypto/tls does not expose the negotiated curve)"
+
+// buildTLSConfig turns connectTLSOptions into a *tls.Config ready to hand to
+// tls.Client. requested is filled in via GetClientCertificate if the server
+// asks for a client certificate during the handshake.
+func buildTLSConfig(opts connectTLSOptions, serverName string, requested *handshakeInfo) (*tls.Config, error) {
+	config := &tls.Config{
+		// We verify the chain ourselves afterwards so we can print results
+		// even when validation fails.
+		InsecureSkipVerify: true,
+		ServerName:         serverName,
+		NextProtos:         opts.ALPN,
+	}
+
+	if opts.MinVersion != "" {
+		version, ok := tlsVersions[opts.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", opts.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	if opts.MaxVersion != "" {
+		version, ok := tlsVersions[opts.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", opts.MaxVersion)
+		}
+		config.MaxVersion = version
+	}
+
+	for _, name := range opts.Ciphers {
+		suite, ok := cipherSuitesByName[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, suite)
+	}
+
+	for _, name := range opts.Curves {
+		curve, ok := tlsCurves[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+
+	if opts.CertPath != "" {
+		cert, err := loadClientCertificate(opts)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			requested.ClientCertRequested = true
+			for _, ca := range cri.AcceptableCAs {
+				requested.AcceptableClientCAs = append(requested.AcceptableClientCAs, fmt.Sprintf("%x", ca))
+			}
+			return cert, nil
+		}
+	} else {
+		config.GetClientCertificate = func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			requested.ClientCertRequested = true
+			for _, ca := range cri.AcceptableCAs {
+				requested.AcceptableClientCAs = append(requested.AcceptableClientCAs, fmt.Sprintf("%x", ca))
+			}
+			return &tls.Certificate{}, nil
+		}
+	}
+
+	return config, nil
+}
+
+// loadClientCertificate loads the client certificate/key pair named by
+// opts.CertPath/KeyPath: a PKCS12 bundle if CertPassword is set (KeyPath is
+// ignored in that case), or a PEM cert/key pair otherwise.
+func loadClientCertificate(opts connectTLSOptions) (*tls.Certificate, error) {
+	if opts.CertPassword != "" {
+		pfxData, err := ioutil.ReadFile(opts.CertPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client cert %s: %s", opts.CertPath, err)
+		}
+		key, cert, err := pkcs12.Decode(pfxData, opts.CertPassword)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode PKCS12 client cert: %s", err)
+		}
+		return &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}, nil
+	}
+
+	if opts.KeyPath == "" {
+		return nil, fmt.Errorf("--key is required when --cert is a PEM file")
+	}
+	cert, err := tls.LoadX509KeyPair(opts.CertPath, opts.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load client certificate: %s", err)
+	}
+	return &cert, nil
+}
+
+// summarizeHandshake reads back the negotiated parameters from a completed
+// tls.Conn's ConnectionState.
+func summarizeHandshake(state tls.ConnectionState, info *handshakeInfo) {
+	info.Version = tlsVersionName(state.Version)
+	info.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	info.NegotiatedProtocol = state.NegotiatedProtocol
+	info.Curve = curveNotExposed
+}
+
+// printHandshakeInfo prints the negotiated TLS parameters in the
+// human-readable format used by connect when --json isn't given.
+func printHandshakeInfo(info handshakeInfo) {
+	fmt.Printf("Negotiated TLS Version: %s\n", info.Version)
+	fmt.Printf("Negotiated Cipher Suite: %s\n", info.CipherSuite)
+	fmt.Printf("Negotiated Curve: %s\n", info.Curve)
+	if info.NegotiatedProtocol != "" {
+		fmt.Printf("Negotiated ALPN Protocol: %s\n", info.NegotiatedProtocol)
+	}
+	if info.ClientCertRequested {
+		fmt.Println("Server requested a client certificate.")
+	}
+	fmt.Println()
+}
+
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+	return fmt.Sprintf("unknown (0x%04x)", version)
+}
@@ -0,0 +1,129 @@
+/*-
+ * Copyright 2016 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// VerifyResult is the outcome of verifying a certificate chain against a
+// server name, as produced by the verify and connect subcommands.
+type VerifyResult struct {
+	Error       string                `json:"error,omitempty"`
+	Chains      [][]simpleCertificate `json:"chains,omitempty"`
+	Revocations []revocationResult    `json:"revocations,omitempty"`
+}
+
+// verifyChain builds a verified certificate chain for name using certs (the
+// presented chain) plus either the system roots or the bundle at caPath, and
+// -- if the result carries a usable chain -- checks each certificate's
+// revocation status per revocationOptions.
+func verifyChain(certs []*x509.Certificate, name string, caPath string) VerifyResult {
+	return verifyChainWithOptions(certs, name, caPath, defaultRevocationOptions())
+}
+
+// verifyChainWithOptions is verifyChain with explicit revocation-checking
+// behavior, so connect (which may already have a stapled OCSP response) can
+// override the defaults.
+func verifyChainWithOptions(certs []*x509.Certificate, name string, caPath string, opts revocationOptions) VerifyResult {
+	if len(certs) == 0 {
+		return VerifyResult{Error: "no certificates to verify"}
+	}
+
+	roots, err := loadRoots(caPath)
+	if err != nil {
+		return VerifyResult{Error: err.Error()}
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return VerifyResult{Error: err.Error()}
+	}
+
+	result := VerifyResult{}
+	for _, chain := range chains {
+		simpleChain := make([]simpleCertificate, len(chain))
+		for i, cert := range chain {
+			simpleChain[i] = createSimpleCertificate(certWithName{cert: cert})
+		}
+		result.Chains = append(result.Chains, simpleChain)
+	}
+
+	if opts.Mode != revocationNone && len(chains) > 0 {
+		result.Revocations = checkChainRevocation(chains[0], opts)
+		for _, rev := range result.Revocations {
+			if rev.Status == revocationRevoked {
+				result.Error = fmt.Sprintf("certificate %s is revoked", rev.SerialNumber)
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+// loadRoots returns the system root pool, or the pool parsed out of caPath
+// if one was given.
+func loadRoots(caPath string) (*x509.CertPool, error) {
+	if caPath == "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			return x509.NewCertPool(), nil
+		}
+		return roots, nil
+	}
+
+	pemBytes, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA bundle: %s", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pemBytes) {
+		return nil, fmt.Errorf("unable to parse CA bundle %s", caPath)
+	}
+	return roots, nil
+}
+
+// printVerifyResult prints a VerifyResult in the human-readable format used
+// when --json isn't given.
+func printVerifyResult(result VerifyResult) {
+	if result.Error != "" {
+		fmt.Printf("Failed to verify certificate chain: %s\n", result.Error)
+	} else {
+		fmt.Println("Certificate chain verified successfully.")
+	}
+
+	for i, rev := range result.Revocations {
+		fmt.Printf("Revocation check %d: serial=%s status=%s source=%s", i+1, rev.SerialNumber, rev.Status, rev.Source)
+		if rev.Reason != "" {
+			fmt.Printf(" reason=%s", rev.Reason)
+		}
+		fmt.Println()
+	}
+}